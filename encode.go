@@ -0,0 +1,173 @@
+/*
+ * Copyright 2024 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// queryResult is the column/row data produced by a single SQL query. It is
+// handed to an encoder to materialize into one of the endpoint's configured
+// wire formats; every format is rendered from the same queryResult, so they
+// all share one ETag.
+type queryResult struct {
+	Columns []string
+	Rows    []any // each element is []any (rowformat "array") or map[string]any (rowformat "object")
+}
+
+// encoder renders a queryResult to w and returns the Content-Type to serve
+// it with.
+type encoder func(qr *queryResult, w io.Writer) (contentType string, err error)
+
+// encoders is the registry of wire formats `format`/`formats` may select.
+var encoders = map[string]encoder{
+	"json":    encodeJSON,
+	"ndjson":  encodeNDJSON,
+	"csv":     encodeCSV,
+	"msgpack": encodeMsgpack,
+	"prom":    encodeProm,
+}
+
+// encodeJSON renders rows as a pretty-printed JSON array, matching
+// ellycache's original (and still default) output format.
+func encodeJSON(qr *queryResult, w io.Writer) (string, error) {
+	fmt.Fprintln(w, "[")
+	for i, row := range qr.Rows {
+		j, err := json.Marshal(row)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal to json: %v", err)
+		}
+		if i > 0 {
+			fmt.Fprintln(w, ",")
+		}
+		fmt.Fprint(w, "  ", string(j))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "]")
+	return "application/json", nil
+}
+
+// encodeNDJSON renders one compact JSON row per line, so it can be streamed
+// and parsed incrementally.
+func encodeNDJSON(qr *queryResult, w io.Writer) (string, error) {
+	for _, row := range qr.Rows {
+		j, err := json.Marshal(row)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal to json: %v", err)
+		}
+		w.Write(j)
+		fmt.Fprintln(w)
+	}
+	return "application/x-ndjson", nil
+}
+
+// encodeCSV renders rows as CSV, with a header row taken from qr.Columns.
+func encodeCSV(qr *queryResult, w io.Writer) (string, error) {
+	cw := csv.NewWriter(w)
+	if len(qr.Columns) > 0 {
+		if err := cw.Write(qr.Columns); err != nil {
+			return "", err
+		}
+	}
+	for _, row := range qr.Rows {
+		values, err := csvRow(qr.Columns, row)
+		if err != nil {
+			return "", err
+		}
+		if err := cw.Write(values); err != nil {
+			return "", err
+		}
+	}
+	cw.Flush()
+	return "text/csv", cw.Error()
+}
+
+func csvRow(columns []string, row any) ([]string, error) {
+	switch r := row.(type) {
+	case []any:
+		out := make([]string, len(r))
+		for i, v := range r {
+			out[i] = csvCell(v)
+		}
+		return out, nil
+	case map[string]any:
+		out := make([]string, len(columns))
+		for i, c := range columns {
+			out[i] = csvCell(r[c])
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("format \"csv\": unsupported row type %T", row)
+	}
+}
+
+func csvCell(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(t)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// encodeMsgpack renders rows as a single MessagePack-encoded array.
+func encodeMsgpack(qr *queryResult, w io.Writer) (string, error) {
+	if err := msgpack.NewEncoder(w).Encode(qr.Rows); err != nil {
+		return "", err
+	}
+	return "application/msgpack", nil
+}
+
+// encodeProm renders rows as Prometheus text exposition, treating each row
+// as one sample: a "name" column for the metric name, a "value" column for
+// the sample value, and any "labels_*" columns as label key/value pairs.
+// It requires rowformat "object".
+func encodeProm(qr *queryResult, w io.Writer) (string, error) {
+	for _, row := range qr.Rows {
+		m, ok := row.(map[string]any)
+		if !ok {
+			return "", errors.New("format \"prom\": requires rowformat \"object\"")
+		}
+		name, _ := m["name"].(string)
+		if name == "" {
+			return "", errors.New(`format "prom": row missing "name" column`)
+		}
+		var labels []string
+		for k, v := range m {
+			if after, ok := strings.CutPrefix(k, "labels_"); ok {
+				labels = append(labels, fmt.Sprintf("%s=%q", after, fmt.Sprint(v)))
+			}
+		}
+		sort.Strings(labels)
+		labelStr := ""
+		if len(labels) > 0 {
+			labelStr = "{" + strings.Join(labels, ",") + "}"
+		}
+		fmt.Fprintf(w, "%s%s %v\n", name, labelStr, m["value"])
+	}
+	return "text/plain; version=0.0.4", nil
+}
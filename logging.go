@@ -0,0 +1,61 @@
+/*
+ * Copyright 2024 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// logger is ellycache's structured logger, configured from the "log" block
+// (or the defaults below, if absent). It replaces the standard library log
+// package so operators get attributes like path, etag, duration_ms and
+// status instead of parsing formatted strings.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// newLogger builds the logger described by c, defaulting to info level and
+// text format when c is nil or its fields are unset. forceDebug raises the
+// level to debug regardless of c, for the "-d" command-line flag.
+func newLogger(c *LogConfig, forceDebug bool) *slog.Logger {
+	level := slog.LevelInfo
+	format := "text"
+	if c != nil {
+		if c.Format != "" {
+			format = c.Format
+		}
+		switch c.Level {
+		case "debug":
+			level = slog.LevelDebug
+		case "warn":
+			level = slog.LevelWarn
+		case "error":
+			level = slog.LevelError
+		}
+	}
+	if forceDebug {
+		level = slog.LevelDebug
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	return slog.New(handler)
+}
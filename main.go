@@ -24,10 +24,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/cespare/xxhash/v2"
@@ -61,9 +60,11 @@ var (
 	cryptKey symmecrypt.Key // key for encrypted files
 	crond    *cron.Cron     // the cron "daemon"
 	pool     *pgxpool.Pool  // the postgres connection pool
-	cache    sync.Map       // the cache
+	cache    CacheStore     // the cache
 )
 
+const defaultStoragePrefix = "/ellycache/" // default value for 'storage.prefix' in config
+
 const defaultMaxConns = 5 // default value for 'maxconns' in config
 
 func printUsage(r io.Writer) {
@@ -124,9 +125,20 @@ func realmain() int {
 		fmt.Fprintf(os.Stderr, "ellycache: error in config file %s: %v\n", cfgFile, err)
 		return 1
 	}
+	logger = newLogger(cfg.Log, flagDebug)
 
-	// create encryption key
-	if cryptKey, err = symmecrypt.NewRandomKey("aes-gcm"); err != nil {
+	// create the encryption key for FileBacked payloads. In etcd storage
+	// mode this must be shared across nodes - a follower (or this same node,
+	// after a restart) decrypts a blob that whichever node was elected
+	// leader encrypted - so it's derived from config instead of randomly
+	// generated; for the default in-process store, a fresh random key each
+	// run is fine, since the same process that encrypts also decrypts.
+	if cfg.Storage != nil && cfg.Storage.Type == "etcd" {
+		cryptKey, err = symmecrypt.NewKey("aes-gcm", cfg.Storage.EncryptionKey)
+	} else {
+		cryptKey, err = symmecrypt.NewRandomKey("aes-gcm")
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "ellycache: failed to create encryption key: %v\n", err)
 		return 1
 	}
@@ -141,6 +153,22 @@ func realmain() int {
 	}
 	defer pool.Close()
 
+	// set up the cache store
+	if cfg.Storage != nil && cfg.Storage.Type == "etcd" {
+		prefix := cfg.Storage.Prefix
+		if prefix == "" {
+			prefix = defaultStoragePrefix
+		}
+		store, err := newEtcdStore(cfg.Storage.Endpoints, prefix, uniqueSchedules(cfg.Endpoints))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ellycache: failed to connect to etcd: %v\n", err)
+			return 1
+		}
+		cache = store
+	} else {
+		cache = newMemStore()
+	}
+
 	// start cron
 	crond = cron.New()
 	for _, e := range cfg.Endpoints {
@@ -150,11 +178,9 @@ func realmain() int {
 			return 1
 		} else {
 			job.entryID = entryID
-			if flagDebug {
-				if s, err := cron.ParseStandard(e.Schedule); err == nil {
-					log.Printf("debug: scheduled %s, next at %s", e.Path,
-						s.Next(time.Now()).Format("2006-01-02 15:04:05"))
-				}
+			if s, err := cron.ParseStandard(e.Schedule); err == nil {
+				logger.Debug("scheduled endpoint", "path", e.Path,
+					"next", s.Next(time.Now()).Format("2006-01-02 15:04:05"))
 			}
 		}
 	}
@@ -164,10 +190,23 @@ func realmain() int {
 		<-ctx.Done()
 	}()
 
+	// start the metrics server, if configured
+	if cfg.Metrics != nil {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("GET "+cfg.Metrics.path(), metricsHandler)
+		metricsSrv := &http.Server{Addr: cfg.Metrics.Listen, Handler: metricsMux}
+		go func() {
+			if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("metrics server error", "error", err)
+			}
+		}()
+		defer metricsSrv.Close()
+	}
+
 	// configure an http mux with the endpoints, wrap in compress handler
 	mux := http.NewServeMux()
 	for _, e := range cfg.Endpoints {
-		mux.HandleFunc("GET "+e.Path, httpHandler)
+		mux.HandleFunc("GET "+e.Path, makeHTTPHandler(&e))
 	}
 	handler := handlers.CompressHandler(mux)
 
@@ -186,6 +225,21 @@ func realmain() int {
 	return 0
 }
 
+// uniqueSchedules returns the distinct cron schedule strings configured
+// across endpoints, in order of first appearance, for pre-starting one
+// election campaign per schedule at etcd store creation.
+func uniqueSchedules(endpoints []EndpointConfig) []string {
+	seen := make(map[string]bool)
+	var schedules []string
+	for _, e := range endpoints {
+		if !seen[e.Schedule] {
+			seen[e.Schedule] = true
+			schedules = append(schedules, e.Schedule)
+		}
+	}
+	return schedules
+}
+
 // makePgxCfg creates a pgxpool.Config from a ConnectionConfig.
 func makePgxCfg(c *ConnectionConfig) (*pgxpool.Config, error) {
 	cfg, err := pgxpool.ParseConfig(c.DSN)
@@ -211,86 +265,181 @@ type Job struct {
 }
 
 // Run is the cron job handler for an endpoint. If the query is successful, it
-// updates the cache.
+// updates the cache. A parameterized endpoint instead enumerates its known
+// path-parameter combinations (via KeysSQL or AllowedValues) and updates one
+// cache entry per combination.
 func (j *Job) Run() {
-	// helper to delete old result's file
+	// on a distributed store, only the elected leader for this schedule
+	// runs the query; every node still serves reads out of the cache
+	if elector, ok := cache.(Elector); ok && !elector.IsLeader(j.endpoint.Schedule) {
+		logger.Debug("not leader for schedule, skipping", "schedule", j.endpoint.Schedule, "path", j.endpoint.Path)
+		return
+	}
+
+	names := paramNames(j.endpoint.Path)
+	if len(names) == 0 {
+		j.update(j.endpoint.Path, nil)
+		return
+	}
+
+	variants, err := j.discoverVariants(names)
+	if err != nil {
+		logger.Warn("failed to discover parameter values", "path", j.endpoint.Path, "error", err)
+		return
+	}
+	for _, values := range variants {
+		j.update(expandPath(j.endpoint.Path, values), values)
+	}
+}
+
+// discoverVariants enumerates the known path-parameter combinations for a
+// parameterized endpoint: from KeysSQL if set, else from AllowedValues
+// (only valid for a single path parameter, enforced by Validate).
+func (j *Job) discoverVariants(names []string) ([]map[string]string, error) {
+	e := j.endpoint
+	if e.KeysSQL == "" {
+		variants := make([]map[string]string, len(e.AllowedValues))
+		for i, v := range e.AllowedValues {
+			variants[i] = map[string]string{names[0]: v}
+		}
+		return variants, nil
+	}
+
+	rows, err := pool.Query(context.Background(), e.KeysSQL)
+	if err != nil {
+		return nil, fmt.Errorf("keys_sql failed: %v", err)
+	}
+	defer rows.Close()
+
+	fds := rows.FieldDescriptions()
+	var variants []map[string]string
+	for rows.Next() {
+		vals, err := rows.Values()
+		if err != nil {
+			return nil, fmt.Errorf("keys_sql read failed: %v", err)
+		}
+		values := make(map[string]string, len(fds))
+		for i, fd := range fds {
+			values[fd.Name] = fmt.Sprint(vals[i])
+		}
+		variants = append(variants, values)
+	}
+	return variants, rows.Err()
+}
+
+// update performs the query for one concrete cache key (a plain endpoint's
+// Path, or one parameter variant of it) and stores the result.
+func (j *Job) update(key string, paramValues map[string]string) {
+	// helper to delete old result's local files, if any
 	cleanOld := func(oldResult *EndpointResult) {
-		if oldResult.File != "" {
-			if err := os.Remove(oldResult.File); err != nil {
-				log.Printf("warning: failed to remove file %s: %v", oldResult.File, err)
+		for _, enc := range oldResult.Encodings {
+			if enc.File != "" {
+				if err := os.Remove(enc.File); err != nil {
+					logger.Warn("failed to remove file", "file", enc.File, "error", err)
+				}
 			}
 		}
 	}
 
 	// make new result
-	newResult, err := makeResult(j.endpoint)
+	newResult, err := makeResult(j.endpoint, namedArgs(paramValues))
 	if err != nil {
-		log.Printf("warning: failed to query for %s: %v", j.endpoint.Path, err)
-		if oldResult, loaded := cache.LoadAndDelete(j.endpoint.Path); loaded {
+		logger.Warn("failed to query", "path", key, "error", err)
+		if oldResult, loaded := cache.LoadAndDelete(key); loaded {
 			or, _ := oldResult.(*EndpointResult)
 			cleanOld(or)
-			log.Printf("warning: removed old result for %s", j.endpoint.Path)
+			logger.Warn("removed old result", "path", key)
 		}
 		return
 	}
 	newResult.QueriedAt = time.Now().Truncate(time.Second).In(time.UTC).Format(http.TimeFormat)
 	newResult.CacheControl = fmt.Sprintf("max-age=%d, immutable",
 		int(crond.Entry(j.entryID).Next.Sub(time.Now()).Seconds()))
+	for _, enc := range newResult.Encodings {
+		metrics.observeResultBytes(j.endpoint.Path, len(enc.Result))
+	}
 
 	// update cache, cleanup old entry if present
-	oldResult, loaded := cache.Swap(j.endpoint.Path, newResult)
+	oldResult, loaded := cache.Swap(key, newResult)
+	subs.publish(key, newResult)
 	if loaded {
 		or, _ := oldResult.(*EndpointResult)
 		cleanOld(or)
-		if flagDebug {
-			if or.ETag == newResult.ETag {
-				log.Printf("debug: replaced result for %s (no change in content)", j.endpoint.Path)
-			} else {
-				log.Printf("debug: replaced result for %s", j.endpoint.Path)
-			}
+		if or.ETag == newResult.ETag {
+			logger.Debug("replaced result (no change in content)", "path", key, "etag", newResult.ETag)
+		} else {
+			logger.Debug("replaced result", "path", key, "etag", newResult.ETag)
 		}
-	} else if flagDebug {
-		log.Printf("debug: populated result for %s", j.endpoint.Path)
+	} else {
+		logger.Debug("populated result", "path", key, "etag", newResult.ETag)
 	}
 }
 
-// makeResult performs the query for the endpoint and returns the result.
-func makeResult(e *EndpointConfig) (*EndpointResult, error) {
-	if e.FileBacked {
-		if f, err := os.CreateTemp("", "ellycache"); err != nil {
-			return nil, fmt.Errorf("failed to create temp file: %v", err)
-		} else {
-			defer f.Close()
+// makeResult performs the query for the endpoint (optionally binding args as
+// named SQL parameters) and renders every one of its configured formats
+// from the result, so they all share one ETag.
+func makeResult(e *EndpointConfig, args pgx.NamedArgs) (*EndpointResult, error) {
+	qr, err := query(e, args)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := xxhash.New()
+	for _, row := range qr.Rows {
+		j, err := json.Marshal(row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal to json: %v", err)
+		}
+		digest.Write(j)
+	}
+
+	result := &EndpointResult{
+		ETag:      fmt.Sprintf(`W/"%x"`, digest.Sum64()),
+		Encodings: make(map[string]Encoding),
+	}
+	for _, format := range e.formats() {
+		enc := encoders[format]
+		if e.FileBacked {
+			f, err := os.CreateTemp("", "ellycache")
+			if err != nil {
+				return nil, fmt.Errorf("failed to create temp file: %v", err)
+			}
 			w := symmecrypt.NewWriter(f, cryptKey)
-			defer w.Close()
-			if h, err := query(e, w); err != nil {
+			contentType, encErr := enc(qr, w)
+			w.Close()
+			f.Close()
+			if encErr != nil {
+				os.Remove(f.Name())
+				return nil, encErr
+			}
+			result.Encodings[format] = Encoding{ContentType: contentType, File: f.Name()}
+		} else {
+			b := &bytes.Buffer{}
+			contentType, err := enc(qr, b)
+			if err != nil {
 				return nil, err
-			} else {
-				return &EndpointResult{ETag: fmt.Sprintf(`W/"%x"`, h), File: f.Name()}, nil
 			}
+			result.Encodings[format] = Encoding{ContentType: contentType, Result: b.Bytes()}
 		}
 	}
-
-	b := &bytes.Buffer{}
-	if h, err := query(e, b); err != nil {
-		return nil, err
-	} else {
-		return &EndpointResult{ETag: fmt.Sprintf(`W/"%x"`, h), Result: b.Bytes()}, nil
-	}
+	return result, nil
 }
 
-// query runs the SQL query for and endpoint and writes the result to the given
-// io.Writer.
-func query(e *EndpointConfig, w io.Writer) (uint64, error) {
+// query runs the SQL query for an endpoint, binding args as named
+// parameters if given, and returns the column/row data for encoders to
+// render.
+func query(e *EndpointConfig, args pgx.NamedArgs) (qr *queryResult, err error) {
 	t1 := time.Now()
 	defer func() {
-		if flagDebug {
-			log.Printf("debug: database query for %s took %v", e.Path, time.Since(t1))
+		d := time.Since(t1)
+		rows := 0
+		if qr != nil {
+			rows = len(qr.Rows)
 		}
+		metrics.observeQuery(e.Path, d, rows, err)
+		logger.Debug("database query", "path", e.Path, "duration_ms", d.Milliseconds(), "rows", rows)
 	}()
 
-	digest := xxhash.New()
-
 	ctx := context.Background()
 	if d, err := time.ParseDuration(e.SQLTimeout); err == nil && d > 0 {
 		var cancel context.CancelFunc
@@ -298,25 +447,27 @@ func query(e *EndpointConfig, w io.Writer) (uint64, error) {
 		defer cancel()
 	}
 
-	rows, err := pool.Query(ctx, e.SQL)
+	var rows pgx.Rows
+	if len(args) > 0 {
+		rows, err = pool.Query(ctx, e.SQL, args)
+	} else {
+		rows, err = pool.Query(ctx, e.SQL)
+	}
 	if err != nil {
-		return 0, fmt.Errorf("query failed: %v", err)
+		return nil, fmt.Errorf("query failed: %v", err)
 	}
 	defer rows.Close()
 
 	var columns []string
-	if e.RowFormat != "array" {
-		for _, fd := range rows.FieldDescriptions() {
-			columns = append(columns, fd.Name)
-		}
+	for _, fd := range rows.FieldDescriptions() {
+		columns = append(columns, fd.Name)
 	}
 
-	first := true
-	fmt.Fprintln(w, "[")
+	qr = &queryResult{Columns: columns}
 	for rows.Next() {
 		values, err := rows.Values()
 		if err != nil {
-			return 0, fmt.Errorf("query read failed: %v", err)
+			return nil, fmt.Errorf("query read failed: %v", err)
 		}
 		var row any
 		if e.RowFormat == "array" {
@@ -328,47 +479,79 @@ func query(e *EndpointConfig, w io.Writer) (uint64, error) {
 			}
 			row = m
 		}
-		j, err := json.Marshal(row)
-		if err != nil {
-			return 0, fmt.Errorf("failed to marshal to json: %v", err)
-		}
-		digest.Write(j)
-		if first {
-			first = false
-		} else {
-			fmt.Fprintln(w, ",")
-		}
-		fmt.Fprint(w, "  ")
-		fmt.Fprint(w, string(j))
+		qr.Rows = append(qr.Rows, row)
 	}
 	if err := rows.Err(); err != nil {
-		return 0, fmt.Errorf("query error: %v", err)
+		return nil, fmt.Errorf("query error: %v", err)
+	}
+	return qr, nil
+}
+
+// makeHTTPHandler returns the http.HandlerFunc that serves up content for
+// endpoint e.
+func makeHTTPHandler(e *EndpointConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		httpHandler(w, r, e)
 	}
-	fmt.Fprintln(w)
-	fmt.Fprintln(w, "]")
-	return digest.Sum64(), nil
 }
 
-// httpHandler serves up content for an endpoint.
-func httpHandler(w http.ResponseWriter, r *http.Request) {
+// httpHandler serves up content for endpoint e, negotiating among its
+// configured formats.
+func httpHandler(w http.ResponseWriter, r *http.Request, e *EndpointConfig) {
+	if r.URL.Query().Get("watch") == "1" {
+		streamHandler(w, r)
+		return
+	}
+
 	hdr := w.Header()
 	code := 200
 	t1 := time.Now()
 	defer func() {
-		if flagDebug {
-			log.Printf("debug: %q %d %v", r.URL.Path, code, time.Since(t1))
-		}
+		metrics.observeStatus(e.Path, code)
+		logger.Debug("http request", "path", r.URL.Path, "status", code, "duration_ms", time.Since(t1).Milliseconds())
 	}()
 
-	// load result
-	v, ok := cache.Load(r.URL.Path)
-	if !ok || v == nil {
-		w.Header().Set("Cache-Control", "no-cache, no-store")
+	// resolve the cache key for this request's path/query parameters
+	pathValues := requestPathValues(e, r)
+	queryValues := queryParamValues(e, r)
+	key := canonicalKey(e, pathValues, r.URL.Query())
+
+	// load result, falling back to an on-demand fetch for an unknown
+	// parameter variant, if the endpoint allows it
+	var result *EndpointResult
+	if v, ok := cache.Load(key); ok && v != nil {
+		result, _ = v.(*EndpointResult)
+		metrics.observeCacheHit(e.Path)
+	} else {
+		metrics.observeCacheMiss(e.Path)
+		allowOnDemand := (len(pathValues) == 0 && len(queryValues) > 0) ||
+			(len(pathValues) > 0 && e.OnDemand)
+		if !allowOnDemand {
+			hdr.Set("Cache-Control", "no-cache, no-store")
+			code = http.StatusNotFound
+			http.NotFound(w, r)
+			return
+		}
+		fetched, err := fetchOnDemand(e, key, mergeValues(pathValues, queryValues))
+		if err != nil {
+			hdr.Set("Cache-Control", "no-cache, no-store")
+			code = http.StatusNotFound
+			logger.Warn("on-demand fetch failed", "path", r.URL.Path, "error", err)
+			http.NotFound(w, r)
+			return
+		}
+		result = fetched
+	}
+
+	// negotiate a format among the endpoint's configured encodings
+	enc, ok := negotiateFormat(e, result, r.Header.Get("Accept"))
+	if !ok {
+		hdr.Set("Cache-Control", "no-cache, no-store")
 		code = http.StatusNotFound
 		http.NotFound(w, r)
 		return
 	}
-	result, _ := v.(*EndpointResult)
+
 	sethdr := func() {
 		hdr.Set("ETag", result.ETag)
 		hdr.Set("Last-Modified", result.QueriedAt)
@@ -378,25 +561,34 @@ func httpHandler(w http.ResponseWriter, r *http.Request) {
 	// check etag
 	if r.Header.Get("If-None-Match") == result.ETag {
 		code = http.StatusNotModified
+		metrics.observeNotModified(e.Path)
 		sethdr()
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	// serve from memory
-	if result.File == "" {
-		hdr.Set("Content-Type", "application/json")
+	if enc.File == "" && enc.BlobKey == "" {
+		hdr.Set("Content-Type", enc.ContentType)
 		sethdr()
-		w.Write(result.Result)
+		w.Write(enc.Result)
 		return
 	}
 
-	// serve from file
-	f, err := os.Open(result.File)
+	// serve from a local file, or a shared blob for distributed stores
+	var f io.ReadCloser
+	var err error
+	if enc.File != "" {
+		f, err = os.Open(enc.File)
+	} else if bs, ok := cache.(BlobStore); ok {
+		f, err = bs.OpenBlob(enc.BlobKey)
+	} else {
+		err = fmt.Errorf("result has no local file or blob store to read from")
+	}
 	if err != nil {
 		hdr.Set("Cache-Control", "no-cache, no-store")
 		code = http.StatusInternalServerError
-		log.Printf("http: %s: failed to open file %s: %v", r.URL.Path, result.File, err)
+		logger.Error("failed to open result", "path", r.URL.Path, "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -405,16 +597,39 @@ func httpHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		hdr.Set("Cache-Control", "no-cache, no-store")
 		code = http.StatusInternalServerError
-		log.Printf("http: %s: failed to decrypt file %s: %v", r.URL.Path, result.File, err)
+		logger.Error("failed to decrypt file", "path", r.URL.Path, "file", enc.File, "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	hdr.Set("Content-Type", "application/json")
+	hdr.Set("Content-Type", enc.ContentType)
 	sethdr()
 	if _, err := io.Copy(w, fr); err != nil {
 		code = http.StatusInternalServerError
-		log.Printf("http: %s: failed to write response: %v", r.URL.Path, err)
+		logger.Error("failed to write response", "path", r.URL.Path, "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 }
+
+// negotiateFormat picks which of the endpoint's configured encodings to
+// serve: the first one matching the client's Accept header, or else the
+// first configured format.
+func negotiateFormat(e *EndpointConfig, result *EndpointResult, accept string) (Encoding, bool) {
+	order := e.formats()
+	if accept != "" && accept != "*/*" {
+		for _, part := range strings.Split(accept, ",") {
+			mt := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+			for _, format := range order {
+				if enc, ok := result.Encodings[format]; ok && strings.TrimSpace(strings.SplitN(enc.ContentType, ";", 2)[0]) == mt {
+					return enc, true
+				}
+			}
+		}
+	}
+	for _, format := range order {
+		if enc, ok := result.Encodings[format]; ok {
+			return enc, true
+		}
+	}
+	return Encoding{}, false
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright 2024 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// queryDurationBuckets are the histogram bucket upper bounds for
+// ellycache_query_duration_seconds, in seconds.
+var queryDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is a minimal Prometheus-style cumulative histogram. Callers hold
+// metricsRegistry.mu while touching it.
+type histogram struct {
+	buckets []float64
+	counts  []int64
+	sum     float64
+	count   int64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.sum += v
+	h.count++
+	for i, ub := range h.buckets {
+		if v <= ub {
+			h.counts[i]++
+		}
+	}
+}
+
+// metricsRegistry is ellycache's process-wide self-instrumentation: query
+// and cache-serving counters/histograms, rendered as Prometheus text
+// exposition by the "metrics" block's http.Server. There's no Prometheus
+// client library dependency; like encodeProm, it's hand-rolled.
+type metricsRegistry struct {
+	mu sync.Mutex
+
+	queryDuration map[string]*histogram // by path
+	queryErrors   map[string]int64      // by path
+	queryRows     map[string]int64      // by path, cumulative
+	resultBytes   map[string]int64      // by path, cumulative rendered in-memory bytes
+
+	cacheHits   map[string]int64 // by path
+	cacheMisses map[string]int64
+	notModified map[string]int64
+
+	httpStatus map[statusKey]int64
+}
+
+type statusKey struct {
+	path   string
+	status int
+}
+
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		queryDuration: make(map[string]*histogram),
+		queryErrors:   make(map[string]int64),
+		queryRows:     make(map[string]int64),
+		resultBytes:   make(map[string]int64),
+		cacheHits:     make(map[string]int64),
+		cacheMisses:   make(map[string]int64),
+		notModified:   make(map[string]int64),
+		httpStatus:    make(map[statusKey]int64),
+	}
+}
+
+// observeQuery records one call to query(), successful or not.
+func (m *metricsRegistry) observeQuery(path string, d time.Duration, rows int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.queryDuration[path]
+	if !ok {
+		h = newHistogram(queryDurationBuckets)
+		m.queryDuration[path] = h
+	}
+	h.observe(d.Seconds())
+	if err != nil {
+		m.queryErrors[path]++
+		return
+	}
+	m.queryRows[path] += int64(rows)
+}
+
+func (m *metricsRegistry) observeResultBytes(path string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resultBytes[path] += int64(n)
+}
+
+func (m *metricsRegistry) observeCacheHit(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cacheHits[path]++
+}
+
+func (m *metricsRegistry) observeCacheMiss(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cacheMisses[path]++
+}
+
+func (m *metricsRegistry) observeNotModified(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notModified[path]++
+}
+
+func (m *metricsRegistry) observeStatus(path string, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.httpStatus[statusKey{path, status}]++
+}
+
+// writeMetrics renders the current metrics as Prometheus text exposition,
+// plus the current cache size, which is computed on the fly from cache
+// itself rather than tracked incrementally.
+func (m *metricsRegistry) writeMetrics(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP ellycache_query_duration_seconds Time spent running an endpoint's SQL query.")
+	fmt.Fprintln(w, "# TYPE ellycache_query_duration_seconds histogram")
+	for _, path := range sortedKeys(m.queryDuration) {
+		h := m.queryDuration[path]
+		var running int64
+		for i, ub := range h.buckets {
+			running += h.counts[i]
+			fmt.Fprintf(w, "ellycache_query_duration_seconds_bucket{path=%q,le=%q} %d\n", path, fmt.Sprint(ub), running)
+		}
+		fmt.Fprintf(w, "ellycache_query_duration_seconds_bucket{path=%q,le=\"+Inf\"} %d\n", path, h.count)
+		fmt.Fprintf(w, "ellycache_query_duration_seconds_sum{path=%q} %v\n", path, h.sum)
+		fmt.Fprintf(w, "ellycache_query_duration_seconds_count{path=%q} %d\n", path, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP ellycache_query_errors_total Endpoint queries that failed.")
+	fmt.Fprintln(w, "# TYPE ellycache_query_errors_total counter")
+	for _, path := range sortedKeys(m.queryErrors) {
+		fmt.Fprintf(w, "ellycache_query_errors_total{path=%q} %d\n", path, m.queryErrors[path])
+	}
+
+	fmt.Fprintln(w, "# HELP ellycache_query_rows_total Rows returned by endpoint queries.")
+	fmt.Fprintln(w, "# TYPE ellycache_query_rows_total counter")
+	for _, path := range sortedKeys(m.queryRows) {
+		fmt.Fprintf(w, "ellycache_query_rows_total{path=%q} %d\n", path, m.queryRows[path])
+	}
+
+	fmt.Fprintln(w, "# HELP ellycache_result_bytes_total Bytes rendered into cached in-memory results (file-backed payloads are not counted).")
+	fmt.Fprintln(w, "# TYPE ellycache_result_bytes_total counter")
+	for _, path := range sortedKeys(m.resultBytes) {
+		fmt.Fprintf(w, "ellycache_result_bytes_total{path=%q} %d\n", path, m.resultBytes[path])
+	}
+
+	fmt.Fprintln(w, "# HELP ellycache_cache_hits_total Requests served from an existing cache entry.")
+	fmt.Fprintln(w, "# TYPE ellycache_cache_hits_total counter")
+	for _, path := range sortedKeys(m.cacheHits) {
+		fmt.Fprintf(w, "ellycache_cache_hits_total{path=%q} %d\n", path, m.cacheHits[path])
+	}
+
+	fmt.Fprintln(w, "# HELP ellycache_cache_misses_total Requests with no matching cache entry.")
+	fmt.Fprintln(w, "# TYPE ellycache_cache_misses_total counter")
+	for _, path := range sortedKeys(m.cacheMisses) {
+		fmt.Fprintf(w, "ellycache_cache_misses_total{path=%q} %d\n", path, m.cacheMisses[path])
+	}
+
+	fmt.Fprintln(w, "# HELP ellycache_not_modified_total Requests answered with 304 Not Modified.")
+	fmt.Fprintln(w, "# TYPE ellycache_not_modified_total counter")
+	for _, path := range sortedKeys(m.notModified) {
+		fmt.Fprintf(w, "ellycache_not_modified_total{path=%q} %d\n", path, m.notModified[path])
+	}
+
+	fmt.Fprintln(w, "# HELP ellycache_http_requests_total HTTP responses by endpoint and status code.")
+	fmt.Fprintln(w, "# TYPE ellycache_http_requests_total counter")
+	keys := make([]statusKey, 0, len(m.httpStatus))
+	for k := range m.httpStatus {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "ellycache_http_requests_total{path=%q,status=\"%d\"} %d\n", k.path, k.status, m.httpStatus[k])
+	}
+
+	writeCacheSize(w)
+}
+
+// writeCacheSize ranges over the live cache to report its current size,
+// split between payloads held in memory and those backed by a local file or
+// a BlobStore, which aren't counted towards the in-memory figure.
+func writeCacheSize(w io.Writer) {
+	var memBytes, fileBacked int64
+	cache.Range(func(_, v any) bool {
+		result, ok := v.(*EndpointResult)
+		if !ok {
+			return true
+		}
+		for _, enc := range result.Encodings {
+			if enc.File != "" || enc.BlobKey != "" {
+				fileBacked++
+			} else {
+				memBytes += int64(len(enc.Result))
+			}
+		}
+		return true
+	})
+
+	fmt.Fprintln(w, "# HELP ellycache_cache_memory_bytes Bytes currently held in the in-memory cache.")
+	fmt.Fprintln(w, "# TYPE ellycache_cache_memory_bytes gauge")
+	fmt.Fprintf(w, "ellycache_cache_memory_bytes %d\n", memBytes)
+
+	fmt.Fprintln(w, "# HELP ellycache_cache_file_backed_entries Cached encodings currently held in a file or blob store.")
+	fmt.Fprintln(w, "# TYPE ellycache_cache_file_backed_entries gauge")
+	fmt.Fprintf(w, "ellycache_cache_file_backed_entries %d\n", fileBacked)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricsHandler serves the Prometheus text exposition format for the
+// "metrics" block's http.Server.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.writeMetrics(w)
+}
@@ -35,6 +35,9 @@ import (
 type Config struct {
 	Listen     string           `hcl:"listen"`
 	Connection ConnectionConfig `hcl:"connection,block"`
+	Storage    *StorageConfig   `hcl:"storage,block"`
+	Metrics    *MetricsConfig   `hcl:"metrics,block"`
+	Log        *LogConfig       `hcl:"log,block"`
 	Endpoints  []EndpointConfig `hcl:"endpoint,block"`
 }
 
@@ -45,6 +48,21 @@ func (c *Config) Validate() error {
 	if err := c.Connection.Validate(); err != nil {
 		return err
 	}
+	if c.Storage != nil {
+		if err := c.Storage.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Metrics != nil {
+		if err := c.Metrics.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Log != nil {
+		if err := c.Log.Validate(); err != nil {
+			return err
+		}
+	}
 	if len(c.Endpoints) == 0 {
 		return errors.New("no endpoints defined")
 	}
@@ -56,6 +74,89 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+// MetricsConfig stands up a separate http.Server exposing Prometheus text
+// exposition metrics, independent of the main listener so it can be bound to
+// a private network or scraped without going through the same port as
+// endpoint traffic.
+type MetricsConfig struct {
+	Listen string `hcl:"listen"`
+	Path   string `hcl:"path,optional"`
+}
+
+func (c *MetricsConfig) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("metrics.listen: %v", err)
+	}
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("metrics.path: must start with '/'")
+	}
+	return nil
+}
+
+// path returns c.Path, defaulting to "/metrics".
+func (c *MetricsConfig) path() string {
+	if c.Path == "" {
+		return "/metrics"
+	}
+	return c.Path
+}
+
+// LogConfig configures the structured logger used throughout ellycache in
+// place of the standard library's log package.
+type LogConfig struct {
+	Level  string `hcl:"level,optional"`
+	Format string `hcl:"format,optional"`
+}
+
+func (c *LogConfig) Validate() error {
+	switch c.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log.level: unknown level %q", c.Level)
+	}
+	switch c.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("log.format: unknown format %q", c.Format)
+	}
+	return nil
+}
+
+// StorageConfig configures the CacheStore backend. When absent, or when
+// Type is "memory" (the default), ellycache uses the per-process
+// in-memory cache; "etcd" enables the distributed etcd v3 backend for
+// multi-instance deployments.
+type StorageConfig struct {
+	Type      string   `hcl:"type"`
+	Endpoints []string `hcl:"endpoints,optional"`
+	Prefix    string   `hcl:"prefix,optional"`
+
+	// EncryptionKey is the hex or base64 encoded aes-gcm key used to encrypt
+	// FileBacked payloads before they're uploaded to etcd. Required for
+	// etcd storage: unlike the default in-memory store, where the same
+	// process that encrypts a payload also decrypts it, etcd-backed
+	// payloads are written by whichever node is elected leader and read
+	// back by every other node, so the key must be shared via config
+	// rather than generated fresh per process.
+	EncryptionKey string `hcl:"encryption_key,optional"`
+}
+
+func (c *StorageConfig) Validate() error {
+	switch c.Type {
+	case "", "memory":
+	case "etcd":
+		if len(c.Endpoints) == 0 {
+			return errors.New("storage.endpoints: must be set for etcd storage")
+		}
+		if c.EncryptionKey == "" {
+			return errors.New("storage.encryption_key: must be set for etcd storage, so FileBacked payloads are encrypted with a key shared across nodes")
+		}
+	default:
+		return fmt.Errorf("storage.type: unknown storage type %q", c.Type)
+	}
+	return nil
+}
+
 type ConnectionConfig struct {
 	DSN         string `hcl:"dsn"`
 	MaxConns    int    `hcl:"maxconns"`
@@ -78,15 +179,51 @@ func (c *ConnectionConfig) Validate() error {
 }
 
 type EndpointConfig struct {
-	Path       string `hcl:"path,label"`
-	SQL        string `hcl:"sql"`
-	SQLTimeout string `hcl:"sqltimeout"`
-	Schedule   string `hcl:"schedule"`
-	RowFormat  string `hcl:"rowformat"`
-	FileBacked bool   `hcl:"filebacked"`
+	Path       string   `hcl:"path,label"`
+	SQL        string   `hcl:"sql"`
+	SQLTimeout string   `hcl:"sqltimeout"`
+	Schedule   string   `hcl:"schedule"`
+	RowFormat  string   `hcl:"rowformat"`
+	Format     string   `hcl:"format,optional"`
+	Formats    []string `hcl:"formats,optional"`
+	FileBacked bool     `hcl:"filebacked"`
+
+	// AllowedValues enumerates the candidate values for a Path with exactly
+	// one {name} segment; KeysSQL is a discovery query whose result columns
+	// are named for Path's {name} segments and whose rows enumerate the
+	// combinations to cache, for paths with more than one. Either makes Path
+	// a parameterized endpoint: the cron job caches one variant per
+	// combination, bound to SQL as pgx named parameters.
+	AllowedValues []string `hcl:"allowed_values,optional"`
+	KeysSQL       string   `hcl:"keys_sql,optional"`
+
+	// OnDemand allows a cache miss for an unknown path-parameter value to
+	// trigger a synchronous, rate-limited, singleflight-guarded query
+	// instead of a 404.
+	OnDemand bool `hcl:"on_demand,optional"`
+
+	// Params allow-lists query-string parameters (bound the same way as
+	// path parameters) to prevent unbounded cache key growth. Since their
+	// value space isn't enumerable up front, variants are fetched on
+	// demand; on an endpoint that also has path parameters, only when
+	// OnDemand is set (otherwise a cache miss is a 404).
+	Params []string `hcl:"params,optional"`
+}
+
+// formats returns the set of encodings to materialize for this endpoint:
+// Formats if set, else a single-element list built from Format, defaulting
+// to "json" when neither is set.
+func (e *EndpointConfig) formats() []string {
+	if len(e.Formats) > 0 {
+		return e.Formats
+	}
+	if e.Format != "" {
+		return []string{e.Format}
+	}
+	return []string{"json"}
 }
 
-var rxURI = regexp.MustCompile(`^(/(({[A-Za-z0-9_.-]+})|([A-Za-z0-9_.-]+)))+$`)
+var rxURI = regexp.MustCompile(`^(/(({[A-Za-z_][A-Za-z0-9_]*})|([A-Za-z0-9_.-]+)))+$`)
 
 func (e *EndpointConfig) Validate() error {
 	if !rxURI.MatchString(e.Path) && e.Path != "/" {
@@ -106,6 +243,23 @@ func (e *EndpointConfig) Validate() error {
 	if e.RowFormat != "" && e.RowFormat != "array" && e.RowFormat != "object" {
 		return fmt.Errorf("endpoint \"%s\": invalid rowformat: must be 'array' or 'object'", e.Path)
 	}
+	for _, format := range e.formats() {
+		if _, ok := encoders[format]; !ok {
+			return fmt.Errorf("endpoint \"%s\": invalid format: unknown encoding %q", e.Path, format)
+		}
+		if format == "prom" && e.RowFormat == "array" {
+			return fmt.Errorf("endpoint \"%s\": format \"prom\" requires rowformat \"object\", since each row must carry a \"name\" and \"value\" column", e.Path)
+		}
+	}
+	names := paramNames(e.Path)
+	switch {
+	case len(names) == 0 && (e.KeysSQL != "" || len(e.AllowedValues) > 0):
+		return fmt.Errorf("endpoint \"%s\": keys_sql/allowed_values require a parameterized path", e.Path)
+	case len(names) > 0 && e.KeysSQL == "" && len(e.AllowedValues) == 0:
+		return fmt.Errorf("endpoint \"%s\": a parameterized path requires keys_sql or allowed_values", e.Path)
+	case len(names) > 1 && e.KeysSQL == "":
+		return fmt.Errorf("endpoint \"%s\": allowed_values only supports a single path parameter; use keys_sql for more", e.Path)
+	}
 	return nil
 }
 
@@ -135,6 +289,13 @@ type EndpointResult struct {
 	CacheControl string
 	ValidUntil   time.Time
 	ETag         string
-	Result       []byte
-	File         string // if not empty, result is in this file
+	Encodings    map[string]Encoding // format name -> rendered payload, sharing this ETag
+}
+
+// Encoding is one rendered wire-format variant of an EndpointResult.
+type Encoding struct {
+	ContentType string
+	Result      []byte
+	File        string // if not empty, payload is in this local file
+	BlobKey     string // if not empty, payload is in this key of a BlobStore
 }
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2024 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+)
+
+// rxParam matches a {name} path-parameter segment. The name charset is
+// restricted to Go identifiers since each one is registered as a
+// net/http.ServeMux wildcard, which panics on startup for anything else.
+var rxParam = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// paramNames returns the {name} path-parameter names in path, in order.
+func paramNames(path string) []string {
+	matches := rxParam.FindAllStringSubmatch(path, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	names := make([]string, len(matches))
+	for i, m := range matches {
+		names[i] = m[1]
+	}
+	return names
+}
+
+// expandPath substitutes a parameterized path's {name} segments with
+// concrete values, producing the cache key / URL path for one variant.
+func expandPath(path string, values map[string]string) string {
+	return rxParam.ReplaceAllStringFunc(path, func(seg string) string {
+		return values[seg[1:len(seg)-1]]
+	})
+}
+
+// requestPathValues reads an endpoint's path-parameter values out of a
+// request, as bound by net/http's ServeMux wildcard matching (which uses
+// the same "{name}" syntax as rxURI).
+func requestPathValues(e *EndpointConfig, r *http.Request) map[string]string {
+	names := paramNames(e.Path)
+	if len(names) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(names))
+	for _, n := range names {
+		values[n] = r.PathValue(n)
+	}
+	return values
+}
+
+// namedArgs converts path/query parameter values into pgx named arguments,
+// for binding into an endpoint's SQL as "@name".
+func namedArgs(values map[string]string) pgx.NamedArgs {
+	if len(values) == 0 {
+		return nil
+	}
+	args := make(pgx.NamedArgs, len(values))
+	for k, v := range values {
+		args[k] = v
+	}
+	return args
+}
+
+// canonicalKey builds the cache key for one parameter variant: the path
+// with its {name} segments substituted, followed by any allow-listed query
+// parameters present on the request, in a stable sorted order.
+func canonicalKey(e *EndpointConfig, pathValues map[string]string, query url.Values) string {
+	key := expandPath(e.Path, pathValues)
+	if len(e.Params) == 0 {
+		return key
+	}
+	allowed := append([]string(nil), e.Params...)
+	sort.Strings(allowed)
+	var parts []string
+	for _, name := range allowed {
+		if v := query.Get(name); v != "" {
+			parts = append(parts, fmt.Sprintf("%s=%s", name, v))
+		}
+	}
+	if len(parts) == 0 {
+		return key
+	}
+	return key + "?" + strings.Join(parts, "&")
+}
+
+// queryParamValues extracts an endpoint's allow-listed query-string
+// parameter values from a request.
+func queryParamValues(e *EndpointConfig, r *http.Request) map[string]string {
+	if len(e.Params) == 0 {
+		return nil
+	}
+	q := r.URL.Query()
+	values := make(map[string]string, len(e.Params))
+	for _, name := range e.Params {
+		if v := q.Get(name); v != "" {
+			values[name] = v
+		}
+	}
+	return values
+}
+
+// mergeValues combines path and query parameter values into a single map,
+// for binding as named SQL arguments.
+func mergeValues(pathValues, queryValues map[string]string) map[string]string {
+	if len(queryValues) == 0 {
+		return pathValues
+	}
+	values := make(map[string]string, len(pathValues)+len(queryValues))
+	for k, v := range pathValues {
+		values[k] = v
+	}
+	for k, v := range queryValues {
+		values[k] = v
+	}
+	return values
+}
+
+//------------------------------------------------------------------------------
+
+// onDemandRate caps synchronous on-demand fetches per endpoint, so a burst
+// of requests for novel parameter values can't overwhelm the database.
+const onDemandRate = 5 // fetches/sec, burst 2x
+
+var (
+	onDemandGroup singleflight.Group
+
+	onDemandMu       sync.Mutex
+	onDemandLimiters = make(map[*EndpointConfig]*rate.Limiter)
+)
+
+func onDemandLimiterFor(e *EndpointConfig) *rate.Limiter {
+	onDemandMu.Lock()
+	defer onDemandMu.Unlock()
+	l, ok := onDemandLimiters[e]
+	if !ok {
+		l = rate.NewLimiter(onDemandRate, onDemandRate*2)
+		onDemandLimiters[e] = l
+	}
+	return l
+}
+
+// fetchOnDemand queries and caches a single parameter variant synchronously,
+// on a cache miss for a parameterized endpoint. Concurrent requests for the
+// same key are coalesced via singleflight; bursts across keys are capped by
+// a per-endpoint rate limiter.
+func fetchOnDemand(e *EndpointConfig, key string, values map[string]string) (*EndpointResult, error) {
+	v, err, _ := onDemandGroup.Do(key, func() (any, error) {
+		if !onDemandLimiterFor(e).Allow() {
+			return nil, fmt.Errorf("on-demand fetch rate limit exceeded for %s", e.Path)
+		}
+		result, err := makeResult(e, namedArgs(values))
+		if err != nil {
+			return nil, err
+		}
+		result.QueriedAt = time.Now().Truncate(time.Second).In(time.UTC).Format(http.TimeFormat)
+		result.CacheControl = "max-age=60, must-revalidate" // not tied to a cron schedule
+		for _, enc := range result.Encodings {
+			metrics.observeResultBytes(e.Path, len(enc.Result))
+		}
+		cache.Swap(key, result)
+		subs.publish(key, result)
+		return result, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*EndpointResult), nil
+}
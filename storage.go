@@ -0,0 +1,479 @@
+/*
+ * Copyright 2024 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// CacheStore is the interface implemented by the pluggable cache backends.
+// It mirrors the subset of sync.Map used by Job.Run and httpHandler, so the
+// default in-process implementation is a thin wrapper and callers don't need
+// to know which backend is in use.
+type CacheStore interface {
+	Load(key string) (value any, ok bool)
+	Swap(key string, value any) (previous any, loaded bool)
+	LoadAndDelete(key string) (value any, loaded bool)
+	Range(f func(key, value any) bool)
+}
+
+// Elector is implemented by CacheStore backends that support leader
+// election. Job.Run consults it so that only the elected leader for a given
+// cron schedule executes queries, while every node keeps serving cached
+// reads.
+type Elector interface {
+	IsLeader(schedule string) bool
+}
+
+// BlobStore is implemented by CacheStore backends that keep FileBacked
+// payloads out of the local filesystem. httpHandler uses it in place of
+// os.Open when the loaded EndpointResult carries a BlobKey instead of a
+// local File.
+type BlobStore interface {
+	OpenBlob(key string) (io.ReadCloser, error)
+}
+
+// memStore is the default, per-process CacheStore, backed by a sync.Map.
+type memStore struct {
+	m sync.Map
+}
+
+func newMemStore() *memStore { return &memStore{} }
+
+func (s *memStore) Load(key string) (any, bool)            { return s.m.Load(key) }
+func (s *memStore) Swap(key string, value any) (any, bool) { return s.m.Swap(key, value) }
+func (s *memStore) LoadAndDelete(key string) (any, bool)   { return s.m.LoadAndDelete(key) }
+func (s *memStore) Range(f func(key, value any) bool)      { s.m.Range(f) }
+
+//------------------------------------------------------------------------------
+
+// maxInlineBytes is the largest payload that etcdStore will store inline in
+// the metadata value. Larger in-memory payloads are split into chunk keys,
+// to stay well under etcd's default ~1.5MiB request size limit; a
+// FileBacked payload is always stored as a single blob key, whatever its
+// size.
+const maxInlineBytes = 512 * 1024
+
+// chunkSize is the size of each chunk key written for a payload that
+// exceeds maxInlineBytes.
+const chunkSize = 512 * 1024
+
+// etcdMeta is the JSON value stored at the metadata key for a path, one
+// entry per configured format. A FileBacked payload is always a symmecrypt
+// encrypted blob, matching the encrypted temp file makeResult wrote before
+// upload; any other payload is inlined or split into chunk keys exactly as
+// rendered, in plaintext, same as it would sit in the in-memory store.
+type etcdMeta struct {
+	ETag         string                      `json:"etag"`
+	QueriedAt    string                      `json:"queried_at"`
+	CacheControl string                      `json:"cache_control"`
+	ValidUntil   time.Time                   `json:"valid_until"`
+	Encodings    map[string]etcdEncodingMeta `json:"encodings"`
+}
+
+type etcdEncodingMeta struct {
+	ContentType string `json:"content_type"`
+	Inline      []byte `json:"inline,omitempty"`
+	Chunks      int    `json:"chunks,omitempty"`
+	BlobKey     string `json:"blob_key,omitempty"`
+}
+
+// etcdStore is a CacheStore backed by etcd v3, for multi-instance
+// deployments. Every node serves reads out of a small local read-through
+// cache kept in sync via an etcd Watch on the metadata prefix; only the
+// elected leader for a given cron schedule calls Swap.
+type etcdStore struct {
+	cli    *clientv3.Client
+	prefix string // always ends in "/"
+
+	local sync.Map // path -> *EndpointResult, primed/invalidated by watch()
+
+	electMu   sync.Mutex
+	elections map[string]*electionState
+}
+
+// newEtcdStore connects to the given etcd endpoints and starts the
+// background watch that keeps the local read-through cache primed, plus one
+// election campaign per schedule. Starting every campaign eagerly here,
+// rather than lazily on a schedule's first IsLeader call, gives leadership
+// time to resolve before that first cron tick fires - otherwise every node
+// would report "not leader" for it and the cache would stay empty for a
+// full schedule interval.
+func newEtcdStore(endpoints []string, prefix string, schedules []string) (*etcdStore, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to etcd: %v", err)
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	s := &etcdStore{
+		cli:       cli,
+		prefix:    prefix,
+		elections: make(map[string]*electionState),
+	}
+	go s.watch()
+	for _, schedule := range schedules {
+		es := &electionState{}
+		s.elections[schedule] = es
+		go s.campaign(schedule, es)
+	}
+	return s, nil
+}
+
+func (s *etcdStore) metaKey(path string) string { return s.prefix + "meta" + path }
+
+func (s *etcdStore) blobKey(path, format string) string {
+	return fmt.Sprintf("%sblob%s/%s", s.prefix, path, format)
+}
+
+func (s *etcdStore) chunkKey(path, format string, i int) string {
+	return fmt.Sprintf("%schunks%s/%s/%04d", s.prefix, path, format, i)
+}
+
+// blobPrefix and chunkPrefix are the etcd key prefixes covering every
+// format's blob/chunk keys for path, used to delete them all at once on
+// eviction or when a format is dropped - kept alongside blobKey/chunkKey so
+// a key-layout change can't update one without the other.
+func (s *etcdStore) blobPrefix(path string) string  { return s.prefix + "blob" + path + "/" }
+func (s *etcdStore) chunkPrefix(path string) string { return s.prefix + "chunks" + path + "/" }
+
+// Load returns the cached result for path, first checking the local
+// read-through cache and falling back to a direct etcd read (e.g. for a
+// path not yet seen by this node's watch, right after startup).
+func (s *etcdStore) Load(path string) (any, bool) {
+	if v, ok := s.local.Load(path); ok {
+		return v, true
+	}
+	resp, err := s.cli.Get(context.Background(), s.metaKey(path))
+	if err != nil {
+		logger.Warn("etcd store: get failed", "path", path, "error", err)
+		return nil, false
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, false
+	}
+	result, err := s.decode(path, resp.Kvs[0].Value)
+	if err != nil {
+		logger.Warn("etcd store: decode failed", "path", path, "error", err)
+		return nil, false
+	}
+	s.local.Store(path, result)
+	return result, true
+}
+
+// Swap stores a new result for path and returns the previous one, if any.
+// Only the elected leader for the endpoint's schedule should call this. The
+// "previous" value comes from the local read-through cache rather than a
+// fresh etcd read: callers (Job.update) only use it to clean up local
+// files and compare ETags, and an etcd-backed result never has a local
+// file (FileBacked payloads are
+// always uploaded as a blob), so there's no need to pay for a full decode -
+// chunks included - of the old payload over the network just to discard it.
+func (s *etcdStore) Swap(path string, value any) (any, bool) {
+	old, loaded := s.local.Load(path)
+	result, _ := value.(*EndpointResult)
+	ctx := context.Background()
+
+	// A format dropped from the endpoint's formats/format list entirely
+	// won't be touched by the per-format loop below, so it would otherwise
+	// leak its blob/chunk keys in etcd forever. Clean those up now, from
+	// the old local result rather than a fresh read (same reasoning as
+	// using s.local.Load above).
+	if oldResult, ok := old.(*EndpointResult); ok {
+		for format := range oldResult.Encodings {
+			if _, keep := result.Encodings[format]; !keep {
+				s.cli.Delete(ctx, s.blobKey(path, format))
+				s.cli.Delete(ctx, s.chunkPrefix(path)+format+"/", clientv3.WithPrefix())
+			}
+		}
+	}
+
+	meta := etcdMeta{
+		ETag:         result.ETag,
+		QueriedAt:    result.QueriedAt,
+		CacheControl: result.CacheControl,
+		ValidUntil:   result.ValidUntil,
+		Encodings:    make(map[string]etcdEncodingMeta, len(result.Encodings)),
+	}
+	for format, enc := range result.Encodings {
+		// drop any chunk/blob keys a previous encoding of this path+format
+		// left behind, immediately before overwriting it - not in a batch
+		// up front - so a concurrent reader on this node never sees the
+		// old payload's keys gone for longer than the single Put that
+		// replaces them.
+		s.cli.Delete(ctx, s.blobKey(path, format))
+		s.cli.Delete(ctx, s.chunkPrefix(path)+format+"/", clientv3.WithPrefix())
+
+		em := etcdEncodingMeta{ContentType: enc.ContentType}
+		switch {
+		case enc.File != "":
+			// FileBacked: upload the encrypted temp file written by
+			// makeResult as a shared blob, then drop the local copy -
+			// followers (and this node, on restart) stream it from etcd.
+			b, err := os.ReadFile(enc.File)
+			if err != nil {
+				logger.Warn("etcd store: read file failed", "file", enc.File, "error", err)
+				return old, loaded
+			}
+			em.BlobKey = s.blobKey(path, format)
+			if _, err := s.cli.Put(ctx, em.BlobKey, string(b)); err != nil {
+				logger.Warn("etcd store: put blob failed", "path", path, "format", format, "error", err)
+				return old, loaded
+			}
+			os.Remove(enc.File)
+			enc.File = ""
+			enc.BlobKey = em.BlobKey
+		case len(enc.Result) > maxInlineBytes:
+			n := (len(enc.Result) + chunkSize - 1) / chunkSize
+			for i := 0; i < n; i++ {
+				lo, hi := i*chunkSize, min((i+1)*chunkSize, len(enc.Result))
+				if _, err := s.cli.Put(ctx, s.chunkKey(path, format, i), string(enc.Result[lo:hi])); err != nil {
+					logger.Warn("etcd store: put chunk failed", "chunk", i, "path", path, "format", format, "error", err)
+					return old, loaded
+				}
+			}
+			em.Chunks = n
+		default:
+			em.Inline = enc.Result
+		}
+		meta.Encodings[format] = em
+		result.Encodings[format] = enc
+	}
+
+	b, err := json.Marshal(&meta)
+	if err != nil {
+		logger.Warn("etcd store: marshal metadata failed", "path", path, "error", err)
+		return old, loaded
+	}
+	if _, err := s.cli.Put(ctx, s.metaKey(path), string(b)); err != nil {
+		logger.Warn("etcd store: put metadata failed", "path", path, "error", err)
+		return old, loaded
+	}
+	s.local.Store(path, result)
+	return old, loaded
+}
+
+// LoadAndDelete removes the result (and any chunk/blob keys) for path.
+func (s *etcdStore) LoadAndDelete(path string) (any, bool) {
+	old, loaded := s.Load(path)
+	ctx := context.Background()
+	s.cli.Delete(ctx, s.metaKey(path))
+	s.cli.Delete(ctx, s.blobPrefix(path), clientv3.WithPrefix())
+	s.cli.Delete(ctx, s.chunkPrefix(path), clientv3.WithPrefix())
+	s.local.Delete(path)
+	return old, loaded
+}
+
+// Range iterates over the results currently primed in the local
+// read-through cache. On a follower that has not yet observed every path,
+// this may not cover the full key space; callers that need a full listing
+// should read from etcd directly instead.
+func (s *etcdStore) Range(f func(key, value any) bool) {
+	s.local.Range(f)
+}
+
+// OpenBlob streams a FileBacked payload straight out of etcd.
+func (s *etcdStore) OpenBlob(key string) (io.ReadCloser, error) {
+	resp, err := s.cli.Get(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("blob %s not found", key)
+	}
+	return io.NopCloser(strings.NewReader(string(resp.Kvs[0].Value))), nil
+}
+
+// decode rebuilds an *EndpointResult from a metadata value, fetching
+// chunks from etcd if a payload didn't fit inline.
+func (s *etcdStore) decode(path string, metaValue []byte) (*EndpointResult, error) {
+	var meta etcdMeta
+	if err := json.Unmarshal(metaValue, &meta); err != nil {
+		return nil, err
+	}
+	result := &EndpointResult{
+		ETag:         meta.ETag,
+		QueriedAt:    meta.QueriedAt,
+		CacheControl: meta.CacheControl,
+		ValidUntil:   meta.ValidUntil,
+		Encodings:    make(map[string]Encoding, len(meta.Encodings)),
+	}
+	for format, em := range meta.Encodings {
+		enc := Encoding{ContentType: em.ContentType}
+		switch {
+		case em.BlobKey != "":
+			enc.BlobKey = em.BlobKey // streamed on demand via OpenBlob
+		case em.Chunks > 0:
+			var buf []byte
+			for i := 0; i < em.Chunks; i++ {
+				resp, err := s.cli.Get(context.Background(), s.chunkKey(path, format, i))
+				if err != nil {
+					return nil, fmt.Errorf("get chunk %d for %s: %v", i, format, err)
+				}
+				if len(resp.Kvs) == 0 {
+					return nil, fmt.Errorf("chunk %d for %s missing", i, format)
+				}
+				buf = append(buf, resp.Kvs[0].Value...)
+			}
+			enc.Result = buf
+		default:
+			enc.Result = em.Inline
+		}
+		result.Encodings[format] = enc
+	}
+	return result, nil
+}
+
+// watch keeps the local read-through cache in sync with etcd, so followers
+// can serve reads without hitting etcd on every request. The watch channel
+// can close or be canceled out from under us - e.g. etcd compacts past the
+// revision a lagging follower is still watching from - in which case
+// restarting it from the same old revision would just fail again. So on any
+// close, this re-primes the cache from a fresh Get (picking up the current
+// revision) and re-issues the Watch from there, instead of leaving the
+// follower frozen on stale data with no recovery.
+func (s *etcdStore) watch() {
+	metaPrefix := s.prefix + "meta"
+	for {
+		rev, err := s.prime(metaPrefix)
+		if err != nil {
+			logger.Warn("etcd store: watch re-prime failed", "error", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		wch := s.cli.Watch(context.Background(), metaPrefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+		for resp := range wch {
+			if resp.Canceled {
+				logger.Warn("etcd store: watch canceled, resyncing", "error", resp.Err(), "compact_revision", resp.CompactRevision)
+				break
+			}
+			for _, ev := range resp.Events {
+				path := strings.TrimPrefix(string(ev.Kv.Key), metaPrefix)
+				switch ev.Type {
+				case clientv3.EventTypePut:
+					if result, err := s.decode(path, ev.Kv.Value); err == nil {
+						s.local.Store(path, result)
+					}
+				case clientv3.EventTypeDelete:
+					s.local.Delete(path)
+				}
+			}
+		}
+		logger.Warn("etcd store: watch channel closed, resyncing")
+	}
+}
+
+// prime does a full Get of the metadata prefix and (re)populates the local
+// cache from it, evicting any locally cached path that's no longer present
+// (e.g. deleted by another node while this node's watch was disconnected),
+// and returns the revision to resume watching from.
+func (s *etcdStore) prime(metaPrefix string) (int64, error) {
+	resp, err := s.cli.Get(context.Background(), metaPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	seen := make(map[string]bool, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		path := strings.TrimPrefix(string(kv.Key), metaPrefix)
+		seen[path] = true
+		if result, err := s.decode(path, kv.Value); err == nil {
+			s.local.Store(path, result)
+		}
+	}
+	s.local.Range(func(key, _ any) bool {
+		if path, ok := key.(string); ok && !seen[path] {
+			s.local.Delete(path)
+		}
+		return true
+	})
+	return resp.Header.Revision, nil
+}
+
+//------------------------------------------------------------------------------
+
+// electionState tracks whether this node currently holds leadership for a
+// cron schedule.
+type electionState struct {
+	mu     sync.RWMutex
+	leader bool
+}
+
+// IsLeader reports whether this node is currently the elected leader for
+// schedule. Every configured schedule already has a campaign running from
+// newEtcdStore; this lazily starts one only as a fallback, for a schedule
+// that wasn't known about at startup.
+func (s *etcdStore) IsLeader(schedule string) bool {
+	s.electMu.Lock()
+	es, ok := s.elections[schedule]
+	if !ok {
+		es = &electionState{}
+		s.elections[schedule] = es
+		go s.campaign(schedule, es)
+	}
+	s.electMu.Unlock()
+
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	return es.leader
+}
+
+// campaign runs forever, holding an etcd lease + election for schedule
+// whenever possible, so that exactly one node runs each cron job per
+// schedule while every node keeps serving reads.
+func (s *etcdStore) campaign(schedule string, es *electionState) {
+	const sessionTTL = 15 // seconds
+	name, _ := os.Hostname()
+	for {
+		sess, err := concurrency.NewSession(s.cli, concurrency.WithTTL(sessionTTL))
+		if err != nil {
+			logger.Warn("etcd election: new session failed", "schedule", schedule, "error", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		elec := concurrency.NewElection(sess, s.prefix+"election/"+schedule)
+		if err := elec.Campaign(context.Background(), name); err != nil {
+			logger.Warn("etcd election: campaign failed", "schedule", schedule, "error", err)
+			sess.Close()
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		es.mu.Lock()
+		es.leader = true
+		es.mu.Unlock()
+
+		<-sess.Done() // lease lost: etcd unavailable, session expired, etc.
+
+		es.mu.Lock()
+		es.leader = false
+		es.mu.Unlock()
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright 2024 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// subscriberBuffer is the number of pending events buffered per subscriber
+// before it is considered a slow consumer and evicted.
+const subscriberBuffer = 8
+
+// wsBufferSize is the websocket frame / response buffer size. The
+// gorilla/websocket default is too small to accommodate a full result
+// payload in one frame, so it's sized generously up front instead.
+const wsBufferSize = 1 << 20 // 1 MiB
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  wsBufferSize,
+	WriteBufferSize: wsBufferSize,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// subRegistry fans out EndpointResult updates to the watchers of a path.
+type subRegistry struct {
+	mu   sync.Mutex
+	subs map[string]map[chan *EndpointResult]struct{}
+}
+
+var subs = &subRegistry{subs: make(map[string]map[chan *EndpointResult]struct{})}
+
+func (r *subRegistry) subscribe(path string) chan *EndpointResult {
+	ch := make(chan *EndpointResult, subscriberBuffer)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.subs[path] == nil {
+		r.subs[path] = make(map[chan *EndpointResult]struct{})
+	}
+	r.subs[path][ch] = struct{}{}
+	return ch
+}
+
+func (r *subRegistry) unsubscribe(path string, ch chan *EndpointResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.subs[path], ch)
+}
+
+// publish fans out result to every current subscriber of path. A
+// subscriber whose buffer is full is treated as a slow consumer and
+// dropped, rather than blocking the cron job that called it.
+func (r *subRegistry) publish(path string, result *EndpointResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for ch := range r.subs[path] {
+		select {
+		case ch <- result:
+		default:
+			logger.Warn("slow consumer, dropping subscriber", "path", path)
+			delete(r.subs[path], ch)
+			close(ch)
+		}
+	}
+}
+
+// streamEvent is the JSON event pushed to watchers whenever Job.Run swaps
+// in a new EndpointResult.
+type streamEvent struct {
+	ETag       string          `json:"etag"`
+	QueriedAt  string          `json:"queriedAt"`
+	ValidUntil time.Time       `json:"validUntil,omitempty"`
+	Bytes      int             `json:"bytes"`
+	Data       json.RawMessage `json:"data,omitempty"`
+}
+
+// newStreamEvent builds the event pushed to watchers. Bytes and the
+// optional inline Data always refer to the endpoint's "json" encoding:
+// Bytes is 0 if the endpoint has no "json" encoding or if it is held in a
+// file or blob, and Data is only included for an in-memory "json" encoding.
+func newStreamEvent(result *EndpointResult, includePayload bool) ([]byte, error) {
+	ev := streamEvent{
+		ETag:       result.ETag,
+		QueriedAt:  result.QueriedAt,
+		ValidUntil: result.ValidUntil,
+	}
+	if enc, ok := result.Encodings["json"]; ok {
+		ev.Bytes = len(enc.Result)
+		if includePayload && enc.File == "" && enc.BlobKey == "" {
+			ev.Data = enc.Result
+		}
+	}
+	return json.Marshal(&ev)
+}
+
+// streamHandler serves the companion streaming endpoint for an endpoint's
+// path, selected by the "watch=1" query parameter on the endpoint's own GET
+// route. It upgrades to a WebSocket by default, or serves Server-Sent
+// Events when the client asks for "Accept: text/event-stream". Pass
+// "payload=1" to have events carry the result bytes inline, so watchers can
+// skip a follow-up GET.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	includePayload := r.URL.Query().Get("payload") == "1"
+
+	ch := subs.subscribe(r.URL.Path)
+	defer subs.unsubscribe(r.URL.Path, ch)
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		sseStream(w, r, ch, includePayload)
+		return
+	}
+	wsStream(w, r, ch, includePayload)
+}
+
+func sseStream(w http.ResponseWriter, r *http.Request, ch chan *EndpointResult, includePayload bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/event-stream")
+	hdr.Set("Cache-Control", "no-cache")
+	hdr.Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case result, ok := <-ch:
+			if !ok {
+				return
+			}
+			b, err := newStreamEvent(result, includePayload)
+			if err != nil {
+				logger.Warn("failed to encode stream event", "path", r.URL.Path, "error", err)
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", b)
+			flusher.Flush()
+		}
+	}
+}
+
+func wsStream(w http.ResponseWriter, r *http.Request, ch chan *EndpointResult, includePayload bool) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Error("websocket upgrade failed", "path", r.URL.Path, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// A read pump is required even though this handler never expects
+	// messages from the client: it's the only way to learn the client went
+	// away (gorilla surfaces a closed connection as a ReadMessage error),
+	// and it keeps control frames like pings/pongs/close serviced.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-closed:
+			return
+		case result, ok := <-ch:
+			if !ok {
+				return
+			}
+			b, err := newStreamEvent(result, includePayload)
+			if err != nil {
+				logger.Warn("failed to encode stream event", "path", r.URL.Path, "error", err)
+				continue
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				return
+			}
+		}
+	}
+}